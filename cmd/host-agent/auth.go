@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// loadBearerToken returns the bearer token host-agent requires on every
+// request, read from tokenFile if set, otherwise from
+// /xiaomakai/auth/token in etcd. Returns "" if neither is configured, in
+// which case bearerAuthMiddleware allows all requests through, matching
+// the previous unauthenticated behavior for operators who haven't set
+// this up yet.
+func loadBearerToken(tokenFile string) (string, error) {
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	r, err := etcdcli.Get(c, "/xiaomakai/auth/token")
+	if err != nil {
+		return "", err
+	}
+	if r.Count == 0 {
+		return "", nil
+	}
+	return string(r.Kvs[0].Value), nil
+}
+
+// bearerAuthMiddleware rejects any request whose Authorization header
+// isn't "Bearer <token>". If token is empty, authentication is disabled.
+func bearerAuthMiddleware(token string) iris.Handler {
+	return func(ctx iris.Context) {
+		if token == "" {
+			ctx.Next()
+			return
+		}
+		header := ctx.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") || strings.TrimPrefix(header, "Bearer ") != token {
+			ctx.StatusCode(401)
+			ctx.JSON(iris.Map{"message": "missing or invalid bearer token"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// isNodeEnrolled reports whether node is allowed to receive QMP commands,
+// i.e. has an /xiaomakai/nodes/<node> key in etcd. Operators enroll nodes
+// by creating that key; this keeps the publish/{node} handler from
+// issuing QMP commands to arbitrary hosts.
+func isNodeEnrolled(node string) (bool, error) {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	r, err := etcdcli.Get(c, "/xiaomakai/nodes/"+node)
+	if err != nil {
+		return false, err
+	}
+	return r.Count > 0, nil
+}
@@ -4,16 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
-	"sync"
 	"time"
 
 	"github.com/kataras/iris/v12"
-	"github.com/openxiaoma/umeq-csi/pkg/wrapper"
+	libvirt "libvirt.org/go/libvirt"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/pkg/transport"
+
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend"
+	libvirtbackend "github.com/tasselsd/umeq-csi/pkg/umeq/backend/libvirt"
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend/qemuimg"
 )
 
 var etcdcli *clientv3.Client
@@ -41,27 +45,59 @@ func init() {
 
 var diskRoot string = "/fs/trust/vm/csi/"
 
+// be is the storage backend used by the disk HTTP handlers below, selected
+// in main() via the BACKEND_TYPE env var.
+var be backend.Backend
+
+// newBackend picks a backend.Backend implementation from backendType,
+// defaulting to the qemuimg+QMP backend umeq has always used. "libvirt"
+// connects to LIBVIRT_URI and manages volumes in the LIBVIRT_POOL storage
+// pool instead.
+func newBackend(backendType string) backend.Backend {
+	switch backendType {
+	case "", "qemuimg":
+		return qemuimg.New(diskRoot, etcdcli, func(subcommand string, err error) {
+			qemuImgExitCode.WithLabelValues(subcommand, exitCodeLabel(err)).Inc()
+		})
+	case "libvirt":
+		conn, err := libvirt.NewConnect(os.Getenv("LIBVIRT_URI"))
+		if err != nil {
+			log.Fatalf("failed to connect to libvirt: %v", err)
+		}
+		return libvirtbackend.New(conn, os.Getenv("LIBVIRT_POOL"))
+	default:
+		log.Fatalf("unknown BACKEND_TYPE %q", backendType)
+		return nil
+	}
+}
+
 func main() {
+	be = newBackend(os.Getenv("BACKEND_TYPE"))
+
 	app := iris.New()
 
-	app.Post("/disk/{name:string}/{size:int64}", func(ctx iris.Context) {
+	token, err := loadBearerToken(os.Getenv("HOST_AGENT_TOKEN_FILE"))
+	if err != nil {
+		log.Fatalf("failed to load bearer token: %v", err)
+	}
+	app.Use(bearerAuthMiddleware(token))
+
+	app.Any("/metrics", iris.FromStd(promhttp.Handler()))
+
+	app.Post("/disk/{name:string}/{size:int64}", observeHTTP("disk_create", func(ctx iris.Context) {
 		name := ctx.Params().GetString("name")
 		size := ctx.Params().GetInt64Default("size", 1024*1024*10)
-		qcowPath := diskRoot + name + ".qcow2"
-		cmd := exec.Command("qemu-img", "create", "-f", "qcow2", qcowPath, fmt.Sprintf("%d", size))
-		if out, err := cmd.Output(); err != nil {
+		if err := be.CreateDisk(name, size); err != nil {
 			ctx.StatusCode(500)
 			ctx.JSON(iris.Map{
 				"message": err.Error(),
 			})
-			log.Println("create qcow2 err:", err)
+			log.Println("create disk err:", err)
 			return
-		} else {
-			log.Println("create qcow2:", string(out))
 		}
-	})
+	}))
 
-	app.Put("/disk/{name:string}/{size:int64}", func(ctx iris.Context) {
+	app.Put("/disk/{name:string}/{size:int64}", observeHTTP("disk_resize", func(ctx iris.Context) {
 		name := ctx.Params().GetString("name")
 		size, err := ctx.Params().GetInt64("size")
 		if err != nil {
@@ -71,47 +107,42 @@ func main() {
 			})
 			return
 		}
-		qcowPath := diskRoot + name + ".qcow2"
-		cmd := exec.Command("qemu-img", "resize", qcowPath, fmt.Sprintf("%d", size))
-		if out, err := cmd.Output(); err != nil {
+		if err := be.ResizeDisk(name, size); err != nil {
 			ctx.StatusCode(500)
 			ctx.JSON(iris.Map{
 				"message": err.Error(),
 			})
+			log.Println("resize disk err:", err)
 			return
-		} else {
-			fmt.Println(string(out))
 		}
-	})
+	}))
 
-	app.Delete("/disk/{name:string}", func(ctx iris.Context) {
+	app.Delete("/disk/{name:string}", observeHTTP("disk_delete", func(ctx iris.Context) {
 		name := ctx.Params().GetString("name")
-		err := os.Remove(diskRoot + name + ".qcow2")
-		if err != nil {
+		if err := be.DeleteDisk(name); err != nil {
 			ctx.StatusCode(500)
 			ctx.JSON(iris.Map{
 				"message": err.Error(),
 			})
-			log.Println("delete qcow2 err:", err)
+			log.Println("delete disk err:", err)
 			return
 		}
-		c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		resp, err := etcdcli.Delete(c, "/xiaomakai/"+name)
-		if err != nil {
-			log.Println("etcd delete ERR:", err)
-		} else {
-			log.Printf("etcd resp:%v\n", resp)
-		}
 		fmt.Println("Removed ", name)
-	})
+	}))
 
-	app.Post("/disk/{name:string}/publish/{node:string}", func(ctx iris.Context) {
+	app.Post("/disk/{name:string}/publish/{node:string}", observeHTTP("disk_publish", func(ctx iris.Context) {
 		name := ctx.Params().GetString("name")
 		node := ctx.Params().GetString("node")
-		qcow2Path := diskRoot + name + ".qcow2"
-		err := wrapper.Exec(node, fmt.Sprintf("drive_add 0 if=none,format=qcow2,file=%s,id=%s", qcow2Path, name))
-		if err != nil {
+		if enrolled, err := isNodeEnrolled(node); err != nil {
+			ctx.StatusCode(500)
+			ctx.JSON(iris.Map{"message": err.Error()})
+			return
+		} else if !enrolled {
+			ctx.StatusCode(403)
+			ctx.JSON(iris.Map{"message": "node is not enrolled for QMP access"})
+			return
+		}
+		if _, err := be.AttachDisk(node, name); err != nil {
 			ctx.StatusCode(500)
 			ctx.JSON(iris.Map{
 				"message": err.Error(),
@@ -119,53 +150,29 @@ func main() {
 			log.Println("publish err:", err)
 			return
 		}
+	}))
 
-		c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		r, err := etcdcli.Get(c, "/xiaomakai/"+name)
-		if err != nil {
-			panic(err)
-		}
-		if r.Count == 0 {
-			id := NextID()
-			etcdcli.Put(c, "/xiaomakai/"+name, id)
-			r, err = etcdcli.Get(c, "/xiaomakai/"+name)
-			if err != nil {
-				panic(err)
-			}
+	app.Delete("/disk/{name:string}/publish/{node:string}", observeHTTP("disk_unpublish", func(ctx iris.Context) {
+		name := ctx.Params().GetString("name")
+		node := ctx.Params().GetString("node")
+		if enrolled, err := isNodeEnrolled(node); err != nil {
+			ctx.StatusCode(500)
+			ctx.JSON(iris.Map{"message": err.Error()})
+			return
+		} else if !enrolled {
+			ctx.StatusCode(403)
+			ctx.JSON(iris.Map{"message": "node is not enrolled for QMP access"})
+			return
 		}
-
-		err = wrapper.Exec(node, fmt.Sprintf("device_add virtio-blk-pci,drive=%s,id=%s,serial=%s", name, name, r.Kvs[0].Value))
-		if err != nil {
-			err = wrapper.Exec(node, "drive_del "+name)
-			if err != nil {
-				log.Panicln("error:", err.Error())
-			}
+		if err := be.DetachDisk(node, name); err != nil {
 			ctx.StatusCode(500)
 			ctx.JSON(iris.Map{
 				"message": err.Error(),
 			})
-			log.Println("device_add err:", err)
+			log.Println("unpublish err:", err)
 			return
 		}
-	})
-
-	app.Delete("/disk/{name:string}/publish/{node:string}", func(ctx iris.Context) {
-		name := ctx.Params().GetString("name")
-		node := ctx.Params().GetString("node")
-		err := wrapper.Exec(node, "device_del "+name)
-		if err != nil {
-			err = wrapper.Exec(node, "drive_del "+name)
-			if err != nil {
-				ctx.StatusCode(500)
-				ctx.JSON(iris.Map{
-					"message": err.Error(),
-				})
-				log.Println("unpushlish err:", err)
-				return
-			}
-		}
-	})
+	}))
 
 	app.Get("/dev-path/{name:string}", func(ctx iris.Context) {
 		name := ctx.Params().GetString("name")
@@ -188,6 +195,10 @@ func main() {
 		ctx.Write(r.Kvs[0].Value)
 	})
 
+	app.Post("/snapshot/{disk:string}/{snap:string}", observeHTTP("snapshot_create", createSnapshotHandler))
+	app.Delete("/snapshot/{snap:string}", observeHTTP("snapshot_delete", deleteSnapshotHandler))
+	app.Post("/disk/{name:string}/from-snapshot/{snap:string}", observeHTTP("disk_clone", cloneFromSnapshotHandler))
+
 	app.Get("/capacity", func(ctx iris.Context) {
 		ctx.JSON(iris.Map{
 			"Available":         1024 * 1024 * 1024 * 1024 * 2,
@@ -196,27 +207,38 @@ func main() {
 		})
 	})
 
-	app.Listen(":8080")
-}
+	go pollEtcdVolumeCount(30 * time.Second)
 
-var m sync.Mutex
+	certFile := os.Getenv("HOST_AGENT_TLS_CERT")
+	keyFile := os.Getenv("HOST_AGENT_TLS_KEY")
+	if certFile == "" || keyFile == "" {
+		log.Println("HOST_AGENT_TLS_CERT/HOST_AGENT_TLS_KEY not set, serving plaintext on :8080")
+		app.Listen(":8080")
+		return
+	}
 
-func NextID() string {
-	m.Lock()
-	defer m.Unlock()
-	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	r, err := etcdcli.Get(c, "/xiaomakai/id")
-	if err != nil {
-		panic(err)
+	// Reuse the same cert/key/client-CA layout as the etcd client in
+	// init(), so operators configure a single PKI for both. mTLS is not
+	// optional here: once TLS is on, every caller must present a cert
+	// verified against HOST_AGENT_TLS_CLIENT_CA, so a misconfigured
+	// operator gets a startup failure instead of a server-TLS listener
+	// that silently accepts unauthenticated callers.
+	clientCA := os.Getenv("HOST_AGENT_TLS_CLIENT_CA")
+	if clientCA == "" {
+		log.Fatal("HOST_AGENT_TLS_CLIENT_CA must be set when HOST_AGENT_TLS_CERT/HOST_AGENT_TLS_KEY are set; refusing to serve TLS without requiring client certs")
 	}
-	if r.Count == 0 {
-		etcdcli.Put(c, "/xiaomakai/id", "1")
-	} else {
-		value, _ := strconv.Atoi(string(r.Kvs[0].Value))
-		value += 1
-		etcdcli.Put(c, "/xiaomakai/id", fmt.Sprintf("%d", value))
-		return string(r.Kvs[0].Value)
+	tlsInfo := transport.TLSInfo{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TrustedCAFile:  clientCA,
+		ClientCertAuth: true,
+	}
+	tlsConfig, err := tlsInfo.ServerConfig()
+	if err != nil {
+		log.Fatalf("failed to build TLS config: %v", err)
 	}
-	return "0"
+	app.Run(iris.Server(&http.Server{
+		Addr:      ":8443",
+		TLSConfig: tlsConfig,
+	}))
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kataras/iris/v12"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "umeq_host_agent_http_request_duration_seconds",
+		Help: "Duration of host-agent HTTP handlers, by route and status code.",
+	}, []string{"route", "code"})
+
+	qemuImgExitCode = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "umeq_host_agent_qemu_img_exit_code_total",
+		Help: "Count of qemu-img invocations by subcommand and exit code.",
+	}, []string{"subcommand", "code"})
+
+	etcdVolumeCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "umeq_host_agent_etcd_volume_count",
+		Help: "Number of volumes tracked under /xiaomakai/ in etcd.",
+	})
+)
+
+// observeHTTP wraps an iris handler with a request duration metric keyed by
+// route and response status code.
+func observeHTTP(route string, handler func(ctx iris.Context)) func(ctx iris.Context) {
+	return func(ctx iris.Context) {
+		start := time.Now()
+		handler(ctx)
+		httpRequestDuration.WithLabelValues(route, strconv.Itoa(ctx.GetStatusCode())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// exitCodeLabel renders a qemu-img exec error as the "code" label value
+// for qemuImgExitCode.
+func exitCodeLabel(err error) string {
+	if err == nil {
+		return "0"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return strconv.Itoa(exitErr.ExitCode())
+	}
+	return "unknown"
+}
+
+// pollEtcdVolumeCount periodically refreshes etcdVolumeCount from the
+// number of /xiaomakai/<name> volume keys, leaving out /xiaomakai/id and
+// the nested attach/, snap/, nodes/ and auth/ keys.
+func pollEtcdVolumeCount(interval time.Duration) {
+	for {
+		c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		r, err := etcdcli.Get(c, "/xiaomakai/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		cancel()
+		if err != nil {
+			glog.Errorf("failed to poll etcd volume count: %v", err)
+		} else {
+			volumes := 0
+			for _, kv := range r.Kvs {
+				name := strings.TrimPrefix(string(kv.Key), "/xiaomakai/")
+				if name != "id" && !strings.Contains(name, "/") {
+					volumes++
+				}
+			}
+			etcdVolumeCount.Set(float64(volumes))
+		}
+		time.Sleep(interval)
+	}
+}
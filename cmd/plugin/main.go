@@ -1,11 +1,72 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"time"
 
-	"github.com/tasselsd/umeq-csi/internel/umeq"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	libvirt "libvirt.org/go/libvirt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/pkg/transport"
+
+	"github.com/tasselsd/umeq-csi/pkg/umeq"
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend"
+	libvirtbackend "github.com/tasselsd/umeq-csi/pkg/umeq/backend/libvirt"
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend/qemuimg"
 )
 
+// newEtcdClient dials the same etcd cluster cmd/host-agent uses, reusing
+// the same cert/key/client-CA layout so operators configure one PKI.
+func newEtcdClient() *clientv3.Client {
+	tlsInfo := transport.TLSInfo{
+		CertFile:      "etcd.crt",
+		KeyFile:       "etcd.key",
+		TrustedCAFile: "etcd-ca.crt",
+	}
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"192.168.3.35:2379"},
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cli
+}
+
+// newBackend picks a backend.Backend implementation from BACKEND_TYPE, the
+// same env var and defaulting behavior cmd/host-agent uses, so the
+// Controller's snapshot RPCs operate on the same storage the host-agent
+// HTTP API manages.
+func newBackend(backendType string) backend.Backend {
+	switch backendType {
+	case "", "qemuimg":
+		diskRoot := os.Getenv("DISK_ROOT")
+		if diskRoot == "" {
+			diskRoot = "/fs/trust/vm/csi/"
+		}
+		return qemuimg.New(diskRoot, newEtcdClient(), nil)
+	case "libvirt":
+		conn, err := libvirt.NewConnect(os.Getenv("LIBVIRT_URI"))
+		if err != nil {
+			log.Fatalf("failed to connect to libvirt: %v", err)
+		}
+		return libvirtbackend.New(conn, os.Getenv("LIBVIRT_POOL"))
+	default:
+		log.Fatalf("unknown BACKEND_TYPE %q", backendType)
+		return nil
+	}
+}
+
 func main() {
 	endpoint := os.Getenv("CSI_ENDPOINT")
 	nodeId := os.Getenv("NODE_NAME")
@@ -15,12 +76,40 @@ func main() {
 	if nodeId == "" {
 		panic("system environment NODE_NAME must not empty!")
 	}
-	s := umeq.NewNonBlockingGRPCServer()
-	csi := umeq.Csi{
-		NodeID:        nodeId,
-		DriverName:    "umeq-csi.xiaomakai.com",
-		VendorVersion: "1.0.0",
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		go serveMetrics(metricsAddr)
 	}
-	s.Start("unix://"+endpoint, &csi, &csi, &csi)
+
+	be := newBackend(os.Getenv("BACKEND_TYPE"))
+
+	s := umeq.NewNonBlockingGRPCServer(
+		umeq.WithHealthAndReflection(),
+		umeq.WithPrometheusMetrics(),
+	)
+	ids := umeq.NewIdentityServer("umeq-csi.xiaomakai.com", "1.0.0")
+	cs := umeq.NewControllerServer(be)
+	ns := umeq.NewNodeServer(nodeId)
+	s.Start("unix://"+endpoint, ids, cs, ns)
 	s.Wait()
 }
+
+// serveMetrics exposes Prometheus metrics, pprof profiles and a liveness
+// probe on metricsAddr, independent of the CSI gRPC socket.
+func serveMetrics(metricsAddr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	glog.Infof("Serving metrics on %s", metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		glog.Errorf("metrics server stopped: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backend abstracts the way a volume's bytes are stored and
+// attached to a node, so the HTTP handlers in cmd/host-agent and the CSI
+// Node/Controller code can depend on an interface instead of shelling out
+// to qemu-img and calling wrapper.Exec directly. pkg/umeq/backend/qemuimg
+// implements it on top of qcow2 files and QMP; pkg/umeq/backend/libvirt
+// implements it on top of libvirt storage volumes and hot-attached
+// virtio-blk devices.
+package backend
+
+import "time"
+
+// Info describes a volume as reported by Stat.
+type Info struct {
+	Name      string
+	SizeBytes int64
+}
+
+// SnapshotInfo describes a point-in-time snapshot as reported by
+// CreateSnapshot and ListSnapshots.
+type SnapshotInfo struct {
+	Handle    string
+	Parent    string
+	SizeBytes int64
+	CreatedAt time.Time
+}
+
+// Backend manages the lifecycle of a block volume: creating and sizing its
+// backing storage, attaching/detaching it to a node, and snapshotting or
+// cloning it. Every method is expected to fully own whatever storage
+// mechanism and metadata bookkeeping it needs; callers (cmd/host-agent's
+// HTTP handlers, the CSI Controller/Node code) should not reach around it
+// to exec qemu-img or talk to etcd directly, since that bypasses whatever
+// invariants the concrete backend maintains.
+type Backend interface {
+	CreateDisk(name string, sizeBytes int64) error
+	ResizeDisk(name string, sizeBytes int64) error
+	DeleteDisk(name string) error
+	// AttachDisk makes name visible as a block device on node and returns
+	// the serial the device was attached with, e.g. to build
+	// /dev/disk/by-id/virtio-<serial>.
+	AttachDisk(node, name string) (serial string, err error)
+	DetachDisk(node, name string) error
+	Stat(name string) (Info, error)
+
+	// CreateSnapshot takes a point-in-time snapshot of disk named snap.
+	CreateSnapshot(disk, snap string) (SnapshotInfo, error)
+	// DeleteSnapshot removes a snapshot previously created by
+	// CreateSnapshot.
+	DeleteSnapshot(snap string) error
+	// ListSnapshots pages through known snapshots. startingToken is
+	// opaque and, when non-empty, must be a nextToken value previously
+	// returned by this method; maxEntries <= 0 means no limit. nextToken
+	// is "" once there are no more pages.
+	ListSnapshots(startingToken string, maxEntries int) (snapshots []SnapshotInfo, nextToken string, err error)
+	// CloneFromSnapshot creates a new volume named name backed by snap.
+	CloneFromSnapshot(name, snap string) error
+}
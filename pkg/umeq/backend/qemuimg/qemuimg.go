@@ -0,0 +1,252 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package qemuimg implements backend.Backend on top of local qcow2 files
+// managed with qemu-img, with QMP drive_add/device_add used to attach them
+// to a running node and volume id / attach state tracked in etcd. This is
+// the backend umeq has always used; pkg/umeq/backend/libvirt is the
+// alternative for operators who'd rather manage storage through libvirt.
+package qemuimg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/openxiaoma/umeq-csi/pkg/wrapper"
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend"
+)
+
+// maxNextIDAttempts bounds the CAS retry loop in nextID.
+const maxNextIDAttempts = 10
+
+// ExecObserver is notified with the exit status of every qemu-img
+// invocation, e.g. to record a Prometheus counter. May be nil.
+type ExecObserver func(subcommand string, err error)
+
+// Backend is a backend.Backend backed by qcow2 files under DiskRoot and
+// QMP commands sent via wrapper.Exec, with volume id and attach state kept
+// in etcd under /xiaomakai/.
+type Backend struct {
+	DiskRoot string
+	Etcd     *clientv3.Client
+	Observe  ExecObserver
+}
+
+// New returns a qemuimg Backend rooted at diskRoot, using etcd for volume
+// id allocation and attach bookkeeping. observe may be nil.
+func New(diskRoot string, etcd *clientv3.Client, observe ExecObserver) *Backend {
+	return &Backend{DiskRoot: diskRoot, Etcd: etcd, Observe: observe}
+}
+
+var _ backend.Backend = (*Backend)(nil)
+
+func (b *Backend) path(name string) string {
+	return filepath.Join(b.DiskRoot, name+".qcow2")
+}
+
+func (b *Backend) qemuImg(subcommand string, args ...string) ([]byte, error) {
+	cmd := exec.Command("qemu-img", append([]string{subcommand}, args...)...)
+	out, err := cmd.Output()
+	if b.Observe != nil {
+		b.Observe(subcommand, err)
+	}
+	return out, err
+}
+
+func (b *Backend) CreateDisk(name string, sizeBytes int64) error {
+	_, err := b.qemuImg("create", "-f", "qcow2", b.path(name), fmt.Sprintf("%d", sizeBytes))
+	return err
+}
+
+func (b *Backend) ResizeDisk(name string, sizeBytes int64) error {
+	_, err := b.qemuImg("resize", b.path(name), fmt.Sprintf("%d", sizeBytes))
+	return err
+}
+
+// DeleteDisk refuses to remove name while it's still attached to a node
+// (i.e. /xiaomakai/attach/<name> exists), so a missed unpublish can't leave
+// a QMP drive_add/device_add pointing at a qcow2 file that no longer
+// exists; callers must DetachDisk first.
+func (b *Backend) DeleteDisk(name string) error {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	txnResp, err := b.Etcd.Txn(c).
+		If(clientv3.Compare(clientv3.CreateRevision("/xiaomakai/attach/"+name), "=", 0)).
+		Then(clientv3.OpDelete("/xiaomakai/" + name)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return fmt.Errorf("DeleteDisk: %q is still attached to a node; detach it before deleting", name)
+	}
+
+	return os.Remove(b.path(name))
+}
+
+func (b *Backend) AttachDisk(node, name string) (string, error) {
+	qcow2Path := b.path(name)
+	if err := wrapper.Exec(node, fmt.Sprintf("drive_add 0 if=none,format=qcow2,file=%s,id=%s", qcow2Path, name)); err != nil {
+		return "", err
+	}
+
+	serial, err := b.ensureVolumeID(name)
+	if err != nil {
+		wrapper.Exec(node, "drive_del "+name)
+		return "", err
+	}
+
+	if err := wrapper.Exec(node, fmt.Sprintf("device_add virtio-blk-pci,drive=%s,id=%s,serial=%s", name, name, serial)); err != nil {
+		if delErr := wrapper.Exec(node, "drive_del "+name); delErr != nil {
+			return "", fmt.Errorf("device_add failed (%v) and drive_del rollback also failed: %v", err, delErr)
+		}
+		return "", err
+	}
+
+	if err := b.attachVolume(name, node); err != nil {
+		if delErr := wrapper.Exec(node, "device_del "+name); delErr != nil {
+			return "", fmt.Errorf("attachVolume failed (%v) and device_del rollback also failed: %v", err, delErr)
+		}
+		if delErr := wrapper.Exec(node, "drive_del "+name); delErr != nil {
+			return "", fmt.Errorf("attachVolume failed (%v) and drive_del rollback also failed: %v", err, delErr)
+		}
+		return "", err
+	}
+	return serial, nil
+}
+
+func (b *Backend) DetachDisk(node, name string) error {
+	if err := wrapper.Exec(node, "device_del "+name); err != nil {
+		if err := wrapper.Exec(node, "drive_del "+name); err != nil {
+			return err
+		}
+	}
+	return b.detachVolume(name)
+}
+
+func (b *Backend) Stat(name string) (backend.Info, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return backend.Info{}, err
+	}
+	return backend.Info{Name: name, SizeBytes: fi.Size()}, nil
+}
+
+// nextID atomically allocates the next virtio serial id from
+// /xiaomakai/id using a compare-and-swap transaction, so multiple
+// host-agent replicas racing on the same etcd cluster can't hand out the
+// same id.
+func (b *Backend) nextID() (string, error) {
+	for attempt := 0; attempt < maxNextIDAttempts; attempt++ {
+		c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r, err := b.Etcd.Get(c, "/xiaomakai/id")
+		cancel()
+		if err != nil {
+			return "", err
+		}
+
+		var cur int64
+		var modRevision int64
+		if r.Count > 0 {
+			cur, _ = strconv.ParseInt(string(r.Kvs[0].Value), 10, 64)
+			modRevision = r.Kvs[0].ModRevision
+		}
+		next := strconv.FormatInt(cur+1, 10)
+
+		c, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		txnResp, err := b.Etcd.Txn(c).
+			If(clientv3.Compare(clientv3.ModRevision("/xiaomakai/id"), "=", modRevision)).
+			Then(clientv3.OpPut("/xiaomakai/id", next)).
+			Commit()
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		if txnResp.Succeeded {
+			return next, nil
+		}
+	}
+	return "", fmt.Errorf("nextID: exceeded %d attempts allocating a volume id", maxNextIDAttempts)
+}
+
+// ensureVolumeID returns the virtio serial id stored at /xiaomakai/<name>,
+// allocating and persisting a new one if none exists yet.
+func (b *Backend) ensureVolumeID(name string) (string, error) {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	r, err := b.Etcd.Get(c, "/xiaomakai/"+name)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	if r.Count > 0 {
+		return string(r.Kvs[0].Value), nil
+	}
+
+	id, err := b.nextID()
+	if err != nil {
+		return "", err
+	}
+
+	c, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	txnResp, err := b.Etcd.Txn(c).
+		If(clientv3.Compare(clientv3.CreateRevision("/xiaomakai/"+name), "=", 0)).
+		Then(clientv3.OpPut("/xiaomakai/"+name, id)).
+		Else(clientv3.OpGet("/xiaomakai/" + name)).
+		Commit()
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	if !txnResp.Succeeded {
+		kvs := txnResp.Responses[0].GetResponseRange().Kvs
+		return string(kvs[0].Value), nil
+	}
+	return id, nil
+}
+
+// attachVolume records that name is published to node by creating
+// /xiaomakai/attach/<name>, under a transaction that verifies
+// /xiaomakai/<name> already exists so a racing delete can't strand an
+// attach record with no backing disk key.
+func (b *Backend) attachVolume(name, node string) error {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	txnResp, err := b.Etcd.Txn(c).
+		If(clientv3.Compare(clientv3.CreateRevision("/xiaomakai/"+name), ">", 0)).
+		Then(clientv3.OpPut("/xiaomakai/attach/"+name, node)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return fmt.Errorf("attachVolume: disk key for %q does not exist", name)
+	}
+	return nil
+}
+
+func (b *Backend) detachVolume(name string) error {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := b.Etcd.Delete(c, "/xiaomakai/attach/"+name)
+	return err
+}
@@ -0,0 +1,172 @@
+package qemuimg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEmbeddedEtcd brings up a single-node etcd server rooted in t.TempDir()
+// and returns a client connected to it. The server and client are both
+// cleaned up via t.Cleanup.
+func startEmbeddedEtcd(t *testing.T) *clientv3.Client {
+	t.Helper()
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start embedded etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd did not become ready in time")
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to dial embedded etcd: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+// freePort asks the OS for an unused TCP port by opening and immediately
+// closing a listener on :0, for use in embedded etcd's peer/client URLs.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestNextIDAllocatesSequentially(t *testing.T) {
+	cli := startEmbeddedEtcd(t)
+	b := &Backend{Etcd: cli}
+
+	first, err := b.nextID()
+	if err != nil {
+		t.Fatalf("nextID: %v", err)
+	}
+	second, err := b.nextID()
+	if err != nil {
+		t.Fatalf("nextID: %v", err)
+	}
+	if first == second {
+		t.Fatalf("expected two distinct ids, got %q twice", first)
+	}
+	if first != "1" || second != "2" {
+		t.Fatalf("expected ids 1 then 2 from an empty etcd, got %q then %q", first, second)
+	}
+}
+
+// TestNextIDRejectsRacingWriter checks that the ModRevision compare nextID
+// uses (rebuilt here by clientv3Compare) notices a concurrent writer: if
+// another client bumps /xiaomakai/id between our Get and our Txn, our Txn
+// must fail. It then checks that nextID allocates from the post-race value.
+func TestNextIDRejectsRacingWriter(t *testing.T) {
+	cli := startEmbeddedEtcd(t)
+	b := &Backend{Etcd: cli}
+
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	r, err := cli.Get(c, "/xiaomakai/id")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	// Simulate a racing writer winning the update first.
+	c, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	if _, err := cli.Put(c, "/xiaomakai/id", "41"); err != nil {
+		cancel()
+		t.Fatalf("Put: %v", err)
+	}
+	cancel()
+
+	txnResp, err := cli.Txn(context.Background()).
+		If(clientv3Compare(r)).
+		Then(clientv3.OpPut("/xiaomakai/id", "1")).
+		Commit()
+	if err != nil {
+		t.Fatalf("Txn: %v", err)
+	}
+	if txnResp.Succeeded {
+		t.Fatal("expected the stale-ModRevision transaction to fail once a racing writer updated the key")
+	}
+
+	// nextID reads the now-current value and must build on it rather than
+	// on the value seen before the race.
+	id, err := b.nextID()
+	if err != nil {
+		t.Fatalf("nextID after a race: %v", err)
+	}
+	if id != "42" {
+		t.Fatalf("expected nextID to allocate from the post-race value 41 and return 42, got %q", id)
+	}
+}
+
+func clientv3Compare(r *clientv3.GetResponse) clientv3.Cmp {
+	var modRevision int64
+	if r.Count > 0 {
+		modRevision = r.Kvs[0].ModRevision
+	}
+	return clientv3.Compare(clientv3.ModRevision("/xiaomakai/id"), "=", modRevision)
+}
+
+func TestEnsureVolumeIDIsIdempotent(t *testing.T) {
+	cli := startEmbeddedEtcd(t)
+	b := &Backend{Etcd: cli}
+
+	first, err := b.ensureVolumeID("pvc-1")
+	if err != nil {
+		t.Fatalf("ensureVolumeID: %v", err)
+	}
+	second, err := b.ensureVolumeID("pvc-1")
+	if err != nil {
+		t.Fatalf("ensureVolumeID: %v", err)
+	}
+	if first != second {
+		t.Fatalf("expected a stable id across calls, got %q then %q", first, second)
+	}
+}
+
+func TestAttachVolumeRequiresDiskKey(t *testing.T) {
+	cli := startEmbeddedEtcd(t)
+	b := &Backend{Etcd: cli}
+
+	if err := b.attachVolume("pvc-missing", "node-1"); err == nil {
+		t.Fatal("expected attachVolume to fail when /xiaomakai/<name> doesn't exist yet")
+	}
+
+	if _, err := b.ensureVolumeID("pvc-2"); err != nil {
+		t.Fatalf("ensureVolumeID: %v", err)
+	}
+	if err := b.attachVolume("pvc-2", "node-1"); err != nil {
+		t.Fatalf("attachVolume: %v", err)
+	}
+}
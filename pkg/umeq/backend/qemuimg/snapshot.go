@@ -0,0 +1,149 @@
+package qemuimg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend"
+)
+
+// snapshotRecord is the JSON persisted under /xiaomakai/snap/<name>.
+type snapshotRecord struct {
+	Parent    string    `json:"parent"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+	Handle    string    `json:"handle"`
+}
+
+func (b *Backend) CreateSnapshot(disk, snap string) (backend.SnapshotInfo, error) {
+	diskPath := b.path(disk)
+	if _, err := b.qemuImg("snapshot", "-c", snap, diskPath); err != nil {
+		return backend.SnapshotInfo{}, err
+	}
+
+	info, err := b.Stat(disk)
+	if err != nil {
+		return backend.SnapshotInfo{}, err
+	}
+
+	rec := snapshotRecord{
+		Parent:    disk,
+		SizeBytes: info.SizeBytes,
+		CreatedAt: time.Now(),
+		Handle:    disk + "@" + snap,
+	}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return backend.SnapshotInfo{}, err
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := b.Etcd.Put(c, "/xiaomakai/snap/"+snap, string(body)); err != nil {
+		return backend.SnapshotInfo{}, err
+	}
+
+	return backend.SnapshotInfo{
+		Handle:    rec.Handle,
+		Parent:    rec.Parent,
+		SizeBytes: rec.SizeBytes,
+		CreatedAt: rec.CreatedAt,
+	}, nil
+}
+
+func (b *Backend) DeleteSnapshot(snap string) error {
+	rec, err := b.getSnapshotRecord(snap)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		// Already gone; DeleteSnapshot is expected to be idempotent.
+		return nil
+	}
+
+	if _, err := b.qemuImg("snapshot", "-d", snap, b.path(rec.Parent)); err != nil {
+		return err
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = b.Etcd.Delete(c, "/xiaomakai/snap/"+snap)
+	return err
+}
+
+func (b *Backend) ListSnapshots(startingToken string, maxEntries int) ([]backend.SnapshotInfo, string, error) {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	r, err := b.Etcd.Get(c, "/xiaomakai/snap/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := 0
+	if startingToken != "" {
+		idx := sort.Search(len(r.Kvs), func(i int) bool {
+			return string(r.Kvs[i].Key) > startingToken
+		})
+		start = idx
+	}
+
+	end := len(r.Kvs)
+	if maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	snapshots := make([]backend.SnapshotInfo, 0, end-start)
+	for _, kv := range r.Kvs[start:end] {
+		var rec snapshotRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, "", fmt.Errorf("corrupt snapshot record %q: %w", kv.Key, err)
+		}
+		snapshots = append(snapshots, backend.SnapshotInfo{
+			Handle:    rec.Handle,
+			Parent:    rec.Parent,
+			SizeBytes: rec.SizeBytes,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+
+	nextToken := ""
+	if end < len(r.Kvs) {
+		nextToken = string(r.Kvs[end-1].Key)
+	}
+	return snapshots, nextToken, nil
+}
+
+func (b *Backend) CloneFromSnapshot(name, snap string) error {
+	rec, err := b.getSnapshotRecord(snap)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return fmt.Errorf("snapshot %q not found", snap)
+	}
+
+	_, err = b.qemuImg("create", "-f", "qcow2", "-F", "qcow2", "-b", b.path(rec.Parent), b.path(name))
+	return err
+}
+
+func (b *Backend) getSnapshotRecord(snap string) (*snapshotRecord, error) {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	r, err := b.Etcd.Get(c, "/xiaomakai/snap/"+snap)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if r.Count == 0 {
+		return nil, nil
+	}
+	var rec snapshotRecord
+	if err := json.Unmarshal(r.Kvs[0].Value, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
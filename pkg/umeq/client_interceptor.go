@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package umeq
+
+import (
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+)
+
+// LogGRPC is the client-side counterpart of logGRPC: it logs every
+// outgoing unary RPC at level 3 and, at level 5, its request, its response
+// and a logGRPCJson record, for use by pkg/umeq/connection. Unlike the
+// server, it does not demote Identity.Probe calls to level 5, and its JSON
+// record carries no request.
+func LogGRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	glogClientCall(method, req)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	glogClientResult(method, reply, err)
+	return err
+}
+
+// LogGRPCStream is the streaming counterpart of LogGRPC.
+func LogGRPCStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	glogClientCall(method, nil)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		glogClientResult(method, nil, err)
+	}
+	return stream, err
+}
+
+func glogClientCall(method string, req interface{}) {
+	v5 := glog.V(5)
+	glog.V(3).Infof("GRPC call: %s", method)
+	if v5 && req != nil {
+		v5.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	}
+}
+
+func glogClientResult(method string, reply interface{}, err error) {
+	if err != nil {
+		glog.Errorf("GRPC error: %v", err)
+	}
+	v5 := glog.V(5)
+	if v5 {
+		if reply != nil {
+			v5.Infof("GRPC response: %s", protosanitizer.StripSecrets(reply))
+		}
+		logGRPCJson(method, nil, reply, err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package connection provides a Connect helper modeled after
+// csi-lib-utils/connection: it dials the unix:// and tcp:// endpoints
+// understood by umeq.Parse and blocks until the remote Identity.Probe
+// reports readiness, so callers don't have to reimplement dial-and-probe
+// logic themselves.
+package connection
+
+import (
+	"net"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/tasselsd/umeq-csi/pkg/umeq"
+)
+
+const (
+	defaultProbeBackoff = 1 * time.Second
+)
+
+type options struct {
+	ctx         context.Context
+	dialOptions []grpc.DialOption
+}
+
+// Option configures Connect.
+type Option func(*options)
+
+// WithContext overrides the context used to cancel the dial and the
+// Probe-and-wait loop. Defaults to context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithDialOptions appends extra grpc.DialOption values, e.g. transport
+// credentials for a tcp:// endpoint.
+func WithDialOptions(dialOptions ...grpc.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, dialOptions...)
+	}
+}
+
+// Connect dials endpoint (unix:// or tcp://, same as umeq.Parse) and blocks,
+// retrying with backoff, until the remote Identity.Probe reports ready=true.
+func Connect(endpoint string, opts ...Option) (*grpc.ClientConn, error) {
+	o := options{
+		ctx: context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	proto, addr, err := umeq.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	dialOptions := append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(proto, target, timeout)
+		}),
+		grpc.WithUnaryInterceptor(umeq.LogGRPC),
+		grpc.WithStreamInterceptor(umeq.LogGRPCStream),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}, o.dialOptions...)
+
+	conn, err := grpc.DialContext(o.ctx, addr, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitForReady(o.ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// waitForReady blocks until Identity.Probe returns ready=true, retrying
+// with a fixed backoff until ctx is cancelled.
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	client := csi.NewIdentityClient(conn)
+	for {
+		resp, err := client.Probe(ctx, &csi.ProbeRequest{})
+		if err == nil && (resp.GetReady() == nil || resp.GetReady().GetValue()) {
+			return nil
+		}
+		if err != nil {
+			glog.V(3).Infof("Probe failed, retrying: %v", err)
+		} else {
+			glog.V(3).Infof("Probe not ready yet, retrying")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(defaultProbeBackoff):
+		}
+	}
+}
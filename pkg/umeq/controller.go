@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package umeq
+
+import (
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/tasselsd/umeq-csi/pkg/umeq/backend"
+)
+
+// ControllerServer implements the snapshot lifecycle of csi.ControllerServer
+// on top of a backend.Backend, so CreateSnapshot/DeleteSnapshot/
+// ListSnapshots share the same per-backend implementation as
+// cmd/host-agent's HTTP handlers instead of re-deriving qcow2/etcd logic
+// here. It embeds csi.UnimplementedControllerServer so volume
+// provisioning RPCs (CreateVolume, ControllerPublishVolume, ...), which
+// this series doesn't implement, fail with a clear Unimplemented status
+// instead of a nil-pointer panic. Pass it as the cs argument to
+// nonBlockingGRPCServer.Start/serve.
+type ControllerServer struct {
+	csi.UnimplementedControllerServer
+	Backend backend.Backend
+}
+
+// NewControllerServer returns a ControllerServer backed by be.
+func NewControllerServer(be backend.Backend) *ControllerServer {
+	return &ControllerServer{Backend: be}
+}
+
+func (c *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot requires a source volume id")
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot requires a name")
+	}
+
+	info, err := c.Backend.CreateSnapshot(req.GetSourceVolumeId(), req.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot: %v", err)
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: snapshotInfoToCSI(info),
+	}, nil
+}
+
+func (c *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot requires a snapshot id")
+	}
+
+	if err := c.Backend.DeleteSnapshot(snapshotNameFromHandle(req.GetSnapshotId())); err != nil {
+		return nil, status.Errorf(codes.Internal, "DeleteSnapshot: %v", err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (c *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	snaps, nextToken, err := c.Backend.ListSnapshots(req.GetStartingToken(), int(req.GetMaxEntries()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ListSnapshots: %v", err)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snaps))
+	for _, s := range snaps {
+		if req.GetSourceVolumeId() != "" && s.Parent != req.GetSourceVolumeId() {
+			continue
+		}
+		if req.GetSnapshotId() != "" && s.Handle != req.GetSnapshotId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshotInfoToCSI(s)})
+	}
+
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// ControllerGetCapabilities advertises CREATE_DELETE_SNAPSHOT, which the
+// snapshot RPCs above back, and CLONE_VOLUME. CreateVolume is not
+// implemented by this ControllerServer and returns Unimplemented; clones
+// are made through host-agent's POST /disk/{name}/from-snapshot/{snap}
+// route. Everything else falls through to csi.UnimplementedControllerServer.
+func (c *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	rpcTypes := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	}
+
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, t := range rpcTypes {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: t},
+			},
+		})
+	}
+	return resp, nil
+}
+
+func snapshotInfoToCSI(info backend.SnapshotInfo) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     info.Handle,
+		SourceVolumeId: info.Parent,
+		SizeBytes:      info.SizeBytes,
+		CreationTime:   timestamppb.New(info.CreatedAt),
+		ReadyToUse:     true,
+	}
+}
+
+// snapshotNameFromHandle recovers the snapshot name backend.Backend expects
+// from a "<parent>@<snapshot>" handle, since DeleteSnapshot only knows the
+// snapshot's own etcd key, not its parent.
+func snapshotNameFromHandle(handle string) string {
+	if i := strings.LastIndex(handle, "@"); i >= 0 {
+		return handle[i+1:]
+	}
+	return handle
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package umeq
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// IdentityServer implements csi.IdentityServer: plugin name/version and the
+// liveness probe connection.Connect's waitForReady polls.
+type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+	DriverName    string
+	VendorVersion string
+}
+
+// NewIdentityServer returns an IdentityServer reporting driverName and
+// vendorVersion from GetPluginInfo.
+func NewIdentityServer(driverName, vendorVersion string) *IdentityServer {
+	return &IdentityServer{DriverName: driverName, VendorVersion: vendorVersion}
+}
+
+func (i *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	if i.DriverName == "" {
+		return nil, status.Error(codes.Unavailable, "driver name not configured")
+	}
+	return &csi.GetPluginInfoResponse{
+		Name:          i.DriverName,
+		VendorVersion: i.VendorVersion,
+	}, nil
+}
+
+// GetPluginCapabilities advertises CONTROLLER_SERVICE: the only Controller
+// RPCs this driver backs today are the snapshot ones on ControllerServer.
+func (i *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (i *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package umeq
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// NodeServer implements the identification half of csi.NodeServer.
+// Staging/publishing a volume on the node (formatting and mounting the
+// virtio-blk device host-agent attaches) isn't implemented by any request
+// in this series yet, so those RPCs fall through to
+// csi.UnimplementedNodeServer and return a clear Unimplemented status
+// rather than a nil-pointer panic.
+type NodeServer struct {
+	csi.UnimplementedNodeServer
+	NodeID string
+}
+
+// NewNodeServer returns a NodeServer reporting nodeID from NodeGetInfo.
+func NewNodeServer(nodeID string) *NodeServer {
+	return &NodeServer{NodeID: nodeID}
+}
+
+func (n *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: n.NodeID}, nil
+}
+
+func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
@@ -25,15 +25,90 @@ import (
 	"sync"
 
 	"github.com/golang/glog"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 )
 
-func NewNonBlockingGRPCServer() *nonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+func NewNonBlockingGRPCServer(opts ...Option) *nonBlockingGRPCServer {
+	s := &nonBlockingGRPCServer{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Option configures a nonBlockingGRPCServer. Options are applied in the
+// order they are passed to NewNonBlockingGRPCServer.
+type Option func(*nonBlockingGRPCServer)
+
+// WithUnaryInterceptors appends unary interceptors to the chain that wraps
+// every RPC, in addition to the built-in logGRPC interceptor which always
+// runs first.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.unaryInterceptors = append(s.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithStreamInterceptors appends stream interceptors to the chain that
+// wraps every streaming RPC.
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.streamInterceptors = append(s.streamInterceptors, interceptors...)
+	}
+}
+
+// WithTLSCredentials configures the server to serve over TLS using creds
+// instead of a plaintext listener.
+func WithTLSCredentials(creds credentials.TransportCredentials) Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.serverOpts = append(s.serverOpts, grpc.Creds(creds))
+	}
+}
+
+// WithMaxConcurrentStreams bounds the number of concurrent streams allowed
+// per client connection.
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.serverOpts = append(s.serverOpts, grpc.MaxConcurrentStreams(n))
+	}
+}
+
+// WithServerOptions appends raw grpc.ServerOption values for cases not
+// covered by the other options.
+func WithServerOptions(opts ...grpc.ServerOption) Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.serverOpts = append(s.serverOpts, opts...)
+	}
+}
+
+// WithHealthAndReflection registers the grpc_health_v1 health service and
+// grpc reflection on the server, so grpc_health_probe and grpcurl work
+// against both the CSI unix socket and any tcp:// endpoint.
+func WithHealthAndReflection() Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.healthAndReflection = true
+	}
+}
+
+// WithPrometheusMetrics chains the grpc-ecosystem/go-grpc-prometheus
+// interceptors right after logGRPC and registers per-method request count,
+// latency and error-code metrics with the default prometheus registry.
+// Scrape them by serving grpc_prometheus.DefaultServerMetrics on an HTTP
+// /metrics endpoint, e.g. via the METRICS_ADDR sidecar in cmd/plugin.
+func WithPrometheusMetrics() Option {
+	return func(s *nonBlockingGRPCServer) {
+		s.prometheusMetrics = true
+	}
 }
 
 // NonBlocking server
@@ -41,6 +116,13 @@ type nonBlockingGRPCServer struct {
 	wg      sync.WaitGroup
 	server  *grpc.Server
 	cleanup func()
+
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	serverOpts         []grpc.ServerOption
+
+	healthAndReflection bool
+	prometheusMetrics   bool
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -72,8 +154,20 @@ func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.
 		glog.Fatalf("Failed to listen: %v", err)
 	}
 
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+	unary := []grpc.UnaryServerInterceptor{logGRPC}
+	stream := append([]grpc.StreamServerInterceptor{}, s.streamInterceptors...)
+	if s.prometheusMetrics {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+		unary = append(unary, grpc_prometheus.UnaryServerInterceptor)
+		stream = append(stream, grpc_prometheus.StreamServerInterceptor)
+	}
+	unary = append(unary, s.unaryInterceptors...)
+
+	opts := append([]grpc.ServerOption{
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unary...)),
+	}, s.serverOpts...)
+	if len(stream) > 0 {
+		opts = append(opts, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(stream...)))
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -88,6 +182,15 @@ func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.
 	if ns != nil {
 		csi.RegisterNodeServer(server, ns)
 	}
+	if s.prometheusMetrics {
+		grpc_prometheus.Register(server)
+	}
+	if s.healthAndReflection {
+		healthServer := health.NewServer()
+		healthpb.RegisterHealthServer(server, healthServer)
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		reflection.Register(server)
+	}
 
 	glog.Infof("Listening for connections on address: %#v", listener.Addr())
 
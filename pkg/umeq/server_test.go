@@ -0,0 +1,69 @@
+package umeq
+
+import (
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestWithUnaryInterceptorsAppends(t *testing.T) {
+	s := NewNonBlockingGRPCServer(WithUnaryInterceptors(nil, nil))
+	if len(s.unaryInterceptors) != 2 {
+		t.Fatalf("expected 2 unary interceptors appended, got %d", len(s.unaryInterceptors))
+	}
+}
+
+func TestWithStreamInterceptorsAppends(t *testing.T) {
+	s := NewNonBlockingGRPCServer(WithStreamInterceptors(nil, nil, nil))
+	if len(s.streamInterceptors) != 3 {
+		t.Fatalf("expected 3 stream interceptors appended, got %d", len(s.streamInterceptors))
+	}
+}
+
+func TestWithMaxConcurrentStreamsAddsServerOption(t *testing.T) {
+	s := NewNonBlockingGRPCServer(WithMaxConcurrentStreams(64))
+	if len(s.serverOpts) != 1 {
+		t.Fatalf("expected 1 server option, got %d", len(s.serverOpts))
+	}
+}
+
+func TestWithServerOptionsAppends(t *testing.T) {
+	s := NewNonBlockingGRPCServer(WithServerOptions(grpc.EmptyServerOption{}, grpc.EmptyServerOption{}))
+	if len(s.serverOpts) != 2 {
+		t.Fatalf("expected 2 server options, got %d", len(s.serverOpts))
+	}
+}
+
+func TestWithHealthAndReflectionSetsFlag(t *testing.T) {
+	s := NewNonBlockingGRPCServer()
+	if s.healthAndReflection {
+		t.Fatal("expected healthAndReflection to default to false")
+	}
+
+	s = NewNonBlockingGRPCServer(WithHealthAndReflection())
+	if !s.healthAndReflection {
+		t.Fatal("expected WithHealthAndReflection to set healthAndReflection")
+	}
+}
+
+func TestWithPrometheusMetricsSetsFlag(t *testing.T) {
+	s := NewNonBlockingGRPCServer()
+	if s.prometheusMetrics {
+		t.Fatal("expected prometheusMetrics to default to false")
+	}
+
+	s = NewNonBlockingGRPCServer(WithPrometheusMetrics())
+	if !s.prometheusMetrics {
+		t.Fatal("expected WithPrometheusMetrics to set prometheusMetrics")
+	}
+}
+
+func TestOptionsApplyInOrder(t *testing.T) {
+	s := NewNonBlockingGRPCServer(
+		WithMaxConcurrentStreams(1),
+		WithMaxConcurrentStreams(2),
+	)
+	if len(s.serverOpts) != 2 {
+		t.Fatalf("expected both calls to append rather than overwrite, got %d server options", len(s.serverOpts))
+	}
+}